@@ -3,16 +3,17 @@ package models
 import (
 	"bytes"
 	"cmp"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/opencode-ai/opencode/internal/logging"
@@ -24,118 +25,227 @@ const (
 
 	localModelsPath        = "v1/models"
 	lmStudioBetaModelsPath = "api/v0/models"
-	slotsPath              = "/slots"
+	slotsPath              = "slots"
+	propsPath              = "props"
+	ollamaVersionPath      = "api/version"
+	ollamaTagsPath         = "api/tags"
+	ollamaShowPath         = "api/show"
+
+	defaultLocalDiscoveryTimeout = 5 * time.Second
 )
 
+// localBackendKind identifies which local inference runtime an endpoint is
+// serving. It's used to namespace model IDs (local.<backend>.<id>) so that
+// two runtimes exposing the same model name don't collide in
+// SupportedModels.
+type localBackendKind string
+
 const (
-	// Define a specific log file path for mypackage's init logs if needed,
-	// or use the application's main log file path if known and desired.
-	// For this specific constraint, let's assume it can be the same file path.
-	myPackageLogFilePath  = "./.opencode/init.log"
-	myPackageInitLogLevel = slog.LevelDebug // Level for logs from mypackage's init()
+	backendLlamaCpp localBackendKind = "llamacpp"
+	backendLMStudio localBackendKind = "lmstudio"
+	backendOllama   localBackendKind = "ollama"
 )
 
-var (
-	myPackageInitFile   *os.File     // Global to mypackage to hold the opened file handle
-	myPackageInitLogger *slog.Logger // Local logger for mypackage.init()
-	initLoggerSetupOnce sync.Once    // Ensures init setup only runs once
-)
+// LocalProviderConfig configures a LocalProvider.
+type LocalProviderConfig struct {
+	// Endpoints are the base URLs of the local inference servers to probe,
+	// e.g. "http://localhost:8080" for llama.cpp and "http://localhost:11434"
+	// for Ollama. More than one may be given so users can run several local
+	// runtimes side by side.
+	Endpoints []string
 
-func init() {
-	initLoggerSetupOnce.Do(func() {
-		// Attempt to open the log file for mypackage's init logs.
-		// This will ensure logs from this specific init() go to the file.
-		logDir := filepath.Dir(myPackageLogFilePath)
-		if err := os.MkdirAll(logDir, 0755); err != nil {
-			// Fallback to stderr if we can't even create the directory
-			myPackageInitLogger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-				AddSource: true,
-				Level:     slog.LevelError,
-			}))
-			myPackageInitLogger.Error("CRITICAL: Failed to create log directory for mypackage init logs", "error", err, "path", logDir)
-			return // Cannot proceed with file logging for init
-		}
+	// Timeout bounds each individual HTTP request made during discovery.
+	// Defaults to defaultLocalDiscoveryTimeout when zero.
+	Timeout time.Duration
+}
 
-		file, err := os.OpenFile(myPackageLogFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+// LocalProvider discovers models exposed by one or more local inference
+// servers (llama.cpp, LM Studio, Ollama) on demand, rather than at package
+// init time.
+type LocalProvider struct {
+	endpoints []*url.URL
+	client    *http.Client
+}
+
+// NewLocalProvider builds a LocalProvider for the given config. It performs
+// no network I/O; call Discover to actually probe the endpoints.
+func NewLocalProvider(cfg LocalProviderConfig) (*LocalProvider, error) {
+	endpoints := make([]*url.URL, 0, len(cfg.Endpoints))
+	for _, raw := range cfg.Endpoints {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		endpoint, err := url.Parse(raw)
 		if err != nil {
-			// Fallback to stderr if we can't open the file
-			myPackageInitLogger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-				AddSource: true,
-				Level:     slog.LevelError,
-			}))
-			myPackageInitLogger.Error("CRITICAL: Failed to open log file for mypackage init logs", "error", err, "path", myPackageLogFilePath)
-			return // Cannot proceed with file logging for init
+			return nil, fmt.Errorf("failed to parse local endpoint %q: %w", raw, err)
 		}
-		myPackageInitFile = file // Store the file handle
-
-		// Create a specific logger for mypackage's init function.
-		myPackageInitLogger = slog.New(slog.NewTextHandler(myPackageInitFile, &slog.HandlerOptions{
-			AddSource: true,
-			Level:     myPackageInitLogLevel,
-		}))
+		endpoints = append(endpoints, endpoint)
+	}
 
-		myPackageInitLogger.Info("MyPackage: Init file logger set up.")
-	})
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultLocalDiscoveryTimeout
+	}
 
-	myPackageInitLogger.Debug("called local init")
+	return &LocalProvider{
+		endpoints: endpoints,
+		client:    &http.Client{Timeout: timeout},
+	}, nil
+}
 
-	if endpoint := os.Getenv("LOCAL_ENDPOINT"); endpoint != "" {
-		localEndpoint, err := url.Parse(endpoint)
-		if err != nil {
-			logging.Debug("Failed to parse local endpoint",
-				"error", err,
-				"endpoint", endpoint,
-			)
-			return
+// LocalEndpointsFromEnv resolves the set of local endpoints to probe, in
+// order of precedence: the comma-separated LOCAL_ENDPOINTS env var, the
+// legacy single-valued LOCAL_ENDPOINT env var, then the
+// providers.local.endpoints viper list.
+func LocalEndpointsFromEnv(getenv func(string) string) []string {
+	if raw := getenv("LOCAL_ENDPOINTS"); raw != "" {
+		var endpoints []string
+		for _, e := range strings.Split(raw, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				endpoints = append(endpoints, e)
+			}
 		}
-
-		load := func(url *url.URL, path string) []localModel {
-			url.Path = path
-			return listLocalModels(url.String())
+		if len(endpoints) > 0 {
+			return endpoints
 		}
+	}
 
-		models := load(localEndpoint, lmStudioBetaModelsPath)
+	if endpoint := getenv("LOCAL_ENDPOINT"); endpoint != "" {
+		return []string{endpoint}
+	}
+
+	return viper.GetStringSlice("providers.local.endpoints")
+}
+
+// localBackend knows how to detect and enumerate models for one local
+// inference runtime.
+type localBackend interface {
+	// kind identifies the backend for model ID namespacing.
+	kind() localBackendKind
+
+	// probe reports whether base is serving this backend, via a cheap,
+	// read-only request.
+	probe(ctx context.Context, client *http.Client, base *url.URL) bool
+
+	// listModels returns the models currently exposed at base, with slot
+	// and context-length information merged in where available.
+	listModels(ctx context.Context, client *http.Client, base *url.URL) []localModel
+}
+
+// localBackends is probed in order for every configured endpoint; the first
+// backend whose probe succeeds is used for that endpoint.
+var localBackends = []localBackend{
+	llamaCppBackend{},
+	lmStudioBackend{},
+	ollamaBackend{},
+}
+
+// Discover probes the configured endpoints for available models and their
+// loaded slot state, returning the converted models. It aborts promptly if
+// ctx is cancelled, even mid-read.
+func (p *LocalProvider) Discover(ctx context.Context) ([]Model, error) {
+	discovered, err := p.discoverRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	models := make([]Model, 0, len(discovered))
+	for _, d := range discovered {
+		models = append(models, d.model)
+	}
+	return models, nil
+}
 
-		if len(models) == 0 {
-			models = load(localEndpoint, localModelsPath)
+// discoveredModel pairs a converted Model with the raw backend-specific
+// response it came from, so callers that need more than Discover exposes
+// (the Watcher's state/context-length diffing) don't have to re-probe.
+type discoveredModel struct {
+	backend localBackendKind
+	raw     localModel
+	model   Model
+}
+
+func (p *LocalProvider) discoverRaw(ctx context.Context) ([]discoveredModel, error) {
+	var discovered []discoveredModel
+
+	for _, endpoint := range p.endpoints {
+		backend := detectBackend(ctx, p.client, endpoint)
+		if backend == nil {
+			logging.Debug("No known local backend detected", "endpoint", endpoint.String())
+			continue
 		}
-		myPackageInitLogger.Debug("loaded models", "models", models)
-		if len(models) == 0 {
-			myPackageInitLogger.Debug("No local models found",
-				"endpoint", endpoint,
-			)
-			return
+
+		for _, m := range backend.listModels(ctx, p.client, endpoint) {
+			discovered = append(discovered, discoveredModel{
+				backend: backend.kind(),
+				raw:     m,
+				model:   convertLocalModel(backend.kind(), m),
+			})
 		}
+	}
+
+	return discovered, nil
+}
 
-		loadSlots := func(url *url.URL, path string) []localSlot {
-			url.Path = path
-			return listLocalSlots(url.String())
+// detectBackend probes endpoint against every known backend and returns the
+// first match, or nil if none responds as expected.
+func detectBackend(ctx context.Context, client *http.Client, endpoint *url.URL) localBackend {
+	for _, backend := range localBackends {
+		if backend.probe(ctx, client, endpoint) {
+			return backend
 		}
-		slots := loadSlots(localEndpoint, slotsPath)
-		for is, slot := range slots {
-			for im, m := range models {
-				myPackageInitLogger.Debug("setting ctx form slot", "NCtx", slot.NCtx)
-				if im == is {
-					models[im] = localModel{
-						ID:                  m.ID,
-						Object:              m.Object,
-						Type:                m.Type,
-						Publisher:           m.Publisher,
-						Arch:                m.Arch,
-						CompatibilityType:   m.CompatibilityType,
-						Quantization:        m.Quantization,
-						State:               m.State,
-						MaxContextLength:    slot.NCtx,
-						LoadedContextLength: slot.NCtx,
-					}
-				}
-			}
+	}
+	return nil
+}
+
+// Register is the compatibility shim that wires discovered models into the
+// package-level SupportedModels map, preserving the behavior the old
+// init()-time discovery used to provide. The caller decides when discovery
+// happens (typically during config load), instead of it happening as a side
+// effect of importing this package.
+func (p *LocalProvider) Register(ctx context.Context) error {
+	discovered, err := p.discoverRaw(ctx)
+	if err != nil {
+		return err
+	}
+	if len(discovered) == 0 {
+		return nil
+	}
+
+	for i, d := range discovered {
+		registerSupportedModel(d.model, d.raw.sampling)
+
+		if i == 0 || d.raw.State == "loaded" {
+			viper.SetDefault("agents.coder.model", d.model.ID)
+			viper.SetDefault("agents.summarizer.model", d.model.ID)
+			viper.SetDefault("agents.task.model", d.model.ID)
+			viper.SetDefault("agents.title.model", d.model.ID)
 		}
-		loadLocalModels(models)
+	}
+
+	viper.SetDefault("providers.local.apiKey", "dummy")
+	ProviderPopularity[ProviderLocal] = 0
+	return nil
+}
 
-		viper.SetDefault("providers.local.apiKey", "dummy")
-		ProviderPopularity[ProviderLocal] = 0
+// InitLocalModels resolves local endpoints from the environment and viper
+// config (see LocalEndpointsFromEnv) and, if any are configured, discovers
+// and registers their models. This is the call the application's config
+// loader is expected to make in place of the old init()-time discovery;
+// it is a no-op when no local endpoints are configured.
+func InitLocalModels(ctx context.Context) error {
+	endpoints := LocalEndpointsFromEnv(os.Getenv)
+	if len(endpoints) == 0 {
+		return nil
 	}
+
+	provider, err := NewLocalProvider(LocalProviderConfig{Endpoints: endpoints})
+	if err != nil {
+		return err
+	}
+
+	return provider.Register(ctx)
 }
 
 type localModelList struct {
@@ -153,6 +263,11 @@ type localModel struct {
 	State               string `json:"state"`
 	MaxContextLength    int64  `json:"max_context_length"`
 	LoadedContextLength int64  `json:"loaded_context_length"`
+
+	// sampling carries the sampler parameters observed on the model's
+	// llama.cpp slot, if any. It is not part of the /v1/models response;
+	// listModels fills it in from a matching /slots entry.
+	sampling *SamplingParams
 }
 
 type localSlotList []localSlot
@@ -223,34 +338,54 @@ type localSlot struct {
 	} `json:"next_token"`
 }
 
-func listLocalModels(modelsEndpoint string) []localModel {
-	myPackageInitLogger.Debug("requesting models from", "endpoint", modelsEndpoint)
-	res, err := http.Get(modelsEndpoint)
-	bodyBytes, err := io.ReadAll(res.Body)
-	myPackageInitLogger.Debug("modelList from server", "list", string(bodyBytes))
+// doRequest issues an HTTP request against endpoint using client, which
+// carries the per-request timeout. Binding the request to ctx via
+// http.NewRequestWithContext means ctx cancellation aborts the round trip
+// (including an in-flight read) immediately, without waiting for the
+// timeout to elapse.
+func doRequest(ctx context.Context, client *http.Client, method, endpoint string, body io.Reader) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
 	if err != nil {
-		myPackageInitLogger.Debug("Failed to list local models",
-			"error", err,
-			"endpoint", modelsEndpoint,
-		)
-		return []localModel{}
+		return nil, 0, fmt.Errorf("failed to build request for %s: %w", endpoint, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("request to %s failed: %w", endpoint, err)
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
-		myPackageInitLogger.Debug("Failed to list local models",
-			"status", res.StatusCode,
-			"endpoint", modelsEndpoint,
-		)
+	respBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, res.StatusCode, fmt.Errorf("failed to read response from %s: %w", endpoint, err)
+	}
+
+	return respBody, res.StatusCode, nil
+}
+
+func joinPath(base *url.URL, path string) string {
+	u := *base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(path, "/")
+	return u.String()
+}
+
+func listLocalModels(ctx context.Context, client *http.Client, modelsEndpoint string) []localModel {
+	body, status, err := doRequest(ctx, client, http.MethodGet, modelsEndpoint, nil)
+	if err != nil {
+		logging.Debug("Failed to list local models", "error", err, "endpoint", modelsEndpoint)
+		return []localModel{}
+	}
+	if status != http.StatusOK {
+		logging.Debug("Failed to list local models", "status", status, "endpoint", modelsEndpoint)
 		return []localModel{}
 	}
 
 	var modelList localModelList
-	if err = json.NewDecoder(bytes.NewReader(bodyBytes)).Decode(&modelList); err != nil {
-		myPackageInitLogger.Debug("Failed to list local models",
-			"error", err,
-			"endpoint", modelsEndpoint,
-		)
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&modelList); err != nil {
+		logging.Debug("Failed to list local models", "error", err, "endpoint", modelsEndpoint)
 		return []localModel{}
 	}
 
@@ -258,13 +393,12 @@ func listLocalModels(modelsEndpoint string) []localModel {
 	for _, model := range modelList.Data {
 		if strings.HasSuffix(modelsEndpoint, lmStudioBetaModelsPath) {
 			if model.Object != "model" || model.Type != "llm" {
-				myPackageInitLogger.Debug("Skipping unsupported LMStudio model",
+				logging.Debug("Skipping unsupported LMStudio model",
 					"endpoint", modelsEndpoint,
 					"id", model.ID,
 					"object", model.Object,
 					"type", model.Type,
 				)
-
 				continue
 			}
 		}
@@ -275,56 +409,160 @@ func listLocalModels(modelsEndpoint string) []localModel {
 	return supportedModels
 }
 
-func listLocalSlots(slotEndPoint string) []localSlot {
-	myPackageInitLogger.Debug("requesting slots from", "endpoint", slotEndPoint)
-	res, err := http.Get(slotEndPoint)
+func listLocalSlots(ctx context.Context, client *http.Client, slotEndpoint string) []localSlot {
+	body, status, err := doRequest(ctx, client, http.MethodGet, slotEndpoint, nil)
 	if err != nil {
-		myPackageInitLogger.Debug("Failed to list local slots",
-			"error", err,
-			"endpoint", slotEndPoint,
-		)
+		logging.Debug("Failed to list local slots", "error", err, "endpoint", slotEndpoint)
 		return []localSlot{}
 	}
-	defer res.Body.Close()
-	bodyBytes, err := io.ReadAll(res.Body)
-	if res.StatusCode != http.StatusOK {
-		myPackageInitLogger.Debug("Failed to list local slots",
-			"status", res.StatusCode,
-			"endpoint", slotEndPoint,
-		)
+	if status != http.StatusOK {
+		logging.Debug("Failed to list local slots", "status", status, "endpoint", slotEndpoint)
 		return []localSlot{}
 	}
+
 	var slotList localSlotList
-	if err = json.NewDecoder(bytes.NewReader(bodyBytes)).Decode(&slotList); err != nil {
-		myPackageInitLogger.Debug("Failed to list local slots",
-			"error", err,
-			"endpoint", slotEndPoint,
-		)
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&slotList); err != nil {
+		logging.Debug("Failed to list local slots", "error", err, "endpoint", slotEndpoint)
 		return []localSlot{}
 	}
 
-	myPackageInitLogger.Debug("got slots", "localSlots", slotList)
 	return slotList
 }
 
-func loadLocalModels(models []localModel) {
-	for i, m := range models {
-		model := convertLocalModel(m)
-		SupportedModels[model.ID] = model
+// llamaCppBackend talks to a llama.cpp server's /v1/models, /slots and
+// /props endpoints.
+type llamaCppBackend struct{}
+
+func (llamaCppBackend) kind() localBackendKind { return backendLlamaCpp }
+
+func (llamaCppBackend) probe(ctx context.Context, client *http.Client, base *url.URL) bool {
+	_, status, err := doRequest(ctx, client, http.MethodGet, joinPath(base, propsPath), nil)
+	return err == nil && status == http.StatusOK
+}
+
+func (llamaCppBackend) listModels(ctx context.Context, client *http.Client, base *url.URL) []localModel {
+	models := listLocalModels(ctx, client, joinPath(base, localModelsPath))
+	if len(models) == 0 {
+		return models
+	}
 
-		if i == 0 || m.State == "loaded" {
-			viper.SetDefault("agents.coder.model", model.ID)
-			viper.SetDefault("agents.summarizer.model", model.ID)
-			viper.SetDefault("agents.task.model", model.ID)
-			viper.SetDefault("agents.title.model", model.ID)
+	slots := listLocalSlots(ctx, client, joinPath(base, slotsPath))
+	for is, slot := range slots {
+		for im, m := range models {
+			if im == is {
+				m.MaxContextLength = slot.NCtx
+				m.LoadedContextLength = slot.NCtx
+				sampling := samplingParamsFromSlot(slot)
+				m.sampling = &sampling
+				models[im] = m
+			}
 		}
 	}
+
+	return models
+}
+
+// lmStudioBackend talks to LM Studio's api/v0/models endpoint.
+type lmStudioBackend struct{}
+
+func (lmStudioBackend) kind() localBackendKind { return backendLMStudio }
+
+func (lmStudioBackend) probe(ctx context.Context, client *http.Client, base *url.URL) bool {
+	_, status, err := doRequest(ctx, client, http.MethodGet, joinPath(base, lmStudioBetaModelsPath), nil)
+	return err == nil && status == http.StatusOK
 }
 
-func convertLocalModel(model localModel) Model {
+func (lmStudioBackend) listModels(ctx context.Context, client *http.Client, base *url.URL) []localModel {
+	return listLocalModels(ctx, client, joinPath(base, lmStudioBetaModelsPath))
+}
+
+// ollamaBackend talks to Ollama's api/tags and api/show endpoints.
+type ollamaBackend struct{}
+
+func (ollamaBackend) kind() localBackendKind { return backendOllama }
+
+func (ollamaBackend) probe(ctx context.Context, client *http.Client, base *url.URL) bool {
+	_, status, err := doRequest(ctx, client, http.MethodGet, joinPath(base, ollamaVersionPath), nil)
+	return err == nil && status == http.StatusOK
+}
+
+type ollamaTagsResponse struct {
+	Models []struct {
+		Name string `json:"name"`
+	} `json:"models"`
+}
+
+type ollamaShowResponse struct {
+	ModelInfo map[string]any `json:"model_info"`
+}
+
+func (ollamaBackend) listModels(ctx context.Context, client *http.Client, base *url.URL) []localModel {
+	body, status, err := doRequest(ctx, client, http.MethodGet, joinPath(base, ollamaTagsPath), nil)
+	if err != nil || status != http.StatusOK {
+		logging.Debug("Failed to list Ollama models", "error", err, "status", status)
+		return nil
+	}
+
+	var tags ollamaTagsResponse
+	if err := json.Unmarshal(body, &tags); err != nil {
+		logging.Debug("Failed to decode Ollama tags", "error", err)
+		return nil
+	}
+
+	models := make([]localModel, 0, len(tags.Models))
+	for _, t := range tags.Models {
+		contextLength := ollamaContextLength(ctx, client, base, t.Name)
+		models = append(models, localModel{
+			ID:                  t.Name,
+			Object:              "model",
+			Type:                "llm",
+			State:               "loaded",
+			MaxContextLength:    contextLength,
+			LoadedContextLength: contextLength,
+		})
+	}
+
+	return models
+}
+
+// ollamaContextLength asks Ollama for a model's context length via
+// api/show, which reports it under model_info as "<arch>.context_length".
+func ollamaContextLength(ctx context.Context, client *http.Client, base *url.URL, name string) int64 {
+	reqBody, err := json.Marshal(map[string]string{"name": name})
+	if err != nil {
+		return 0
+	}
+
+	body, status, err := doRequest(ctx, client, http.MethodPost, joinPath(base, ollamaShowPath), bytes.NewReader(reqBody))
+	if err != nil || status != http.StatusOK {
+		logging.Debug("Failed to show Ollama model", "error", err, "status", status, "model", name)
+		return 0
+	}
+
+	var show ollamaShowResponse
+	if err := json.Unmarshal(body, &show); err != nil {
+		logging.Debug("Failed to decode Ollama show response", "error", err, "model", name)
+		return 0
+	}
+
+	for key, value := range show.ModelInfo {
+		if !strings.HasSuffix(key, ".context_length") {
+			continue
+		}
+		if n, ok := value.(float64); ok {
+			return int64(n)
+		}
+	}
+
+	return 0
+}
+
+func convertLocalModel(backend localBackendKind, model localModel) Model {
+	id := ModelID(fmt.Sprintf("local.%s.%s", backend, model.ID))
+
 	return Model{
-		ID:                  ModelID("local." + model.ID),
-		Name:                friendlyModelName(model.ID),
+		ID:                  id,
+		Name:                friendlyModelName(backend, model.ID),
 		Provider:            ProviderLocal,
 		APIModel:            model.ID,
 		ContextWindow:       cmp.Or(model.LoadedContextLength, 4096),
@@ -334,9 +572,357 @@ func convertLocalModel(model localModel) Model {
 	}
 }
 
+// SamplingParams holds the sampler knobs a local inference server exposes
+// (llama.cpp's /slots response has the full set; other backends leave most
+// of these unset). Pointer fields distinguish "not set" from the zero value
+// so that per-agent overrides only replace what the user actually
+// configured.
+type SamplingParams struct {
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopK             *int     `json:"top_k,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	MinP             *float64 `json:"min_p,omitempty"`
+	TypicalP         *float64 `json:"typical_p,omitempty"`
+	RepeatLastN      *int     `json:"repeat_last_n,omitempty"`
+	RepeatPenalty    *float64 `json:"repeat_penalty,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	Mirostat         *int     `json:"mirostat,omitempty"`
+	MirostatTau      *float64 `json:"mirostat_tau,omitempty"`
+	MirostatEta      *float64 `json:"mirostat_eta,omitempty"`
+	DryMultiplier    *float64 `json:"dry_multiplier,omitempty"`
+	DryBase          *float64 `json:"dry_base,omitempty"`
+	DryAllowedLength *int     `json:"dry_allowed_length,omitempty"`
+	DryPenaltyLastN  *int     `json:"dry_penalty_last_n,omitempty"`
+	XtcProbability   *float64 `json:"xtc_probability,omitempty"`
+	XtcThreshold     *float64 `json:"xtc_threshold,omitempty"`
+
+	// Grammar constrains sampling to a GBNF grammar, e.g. to force tool-call
+	// output into a specific shape.
+	Grammar string `json:"grammar,omitempty"`
+	// JSONSchema constrains sampling to a JSON schema; llama.cpp compiles it
+	// to a grammar internally. Mutually exclusive with Grammar.
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+
+	// Extra holds sampler keys the user configured under
+	// agents.<name>.sampling that aren't modeled above; keys reported by the
+	// server are not collected here. For llama.cpp they're forwarded as-is; for
+	// OpenAI-compatible passthrough they're nested under extra_body instead.
+	Extra map[string]any `json:"-"`
+}
+
+// ModelSamplingDefaults holds the sampler defaults observed on each local
+// model's llama.cpp slot at discovery time, keyed by the model's
+// SupportedModels ID. It's the starting point for ResolveSamplingParams;
+// models with no observed slot (LM Studio, Ollama) simply have no entry.
+var ModelSamplingDefaults = map[ModelID]SamplingParams{}
+
+// modelRegistryMu guards SupportedModels and ModelSamplingDefaults, which
+// the Watcher mutates from its own goroutine while the provider's
+// completion path (and the TUI) reads them concurrently. Every read or
+// write of either map in this package goes through the accessors below
+// instead of indexing the maps directly, so a watcher-private lock can't
+// leave readers racing the watcher (Go's map implementation is not safe for
+// concurrent use, even when only one side writes).
+var modelRegistryMu sync.RWMutex
+
+// registerSupportedModel records model (and its sampling defaults, if any)
+// in the shared registry under modelRegistryMu.
+func registerSupportedModel(model Model, sampling *SamplingParams) {
+	modelRegistryMu.Lock()
+	defer modelRegistryMu.Unlock()
+	SupportedModels[model.ID] = model
+	if sampling != nil {
+		ModelSamplingDefaults[model.ID] = *sampling
+	}
+}
+
+// unregisterSupportedModel removes id from the shared registry under
+// modelRegistryMu.
+func unregisterSupportedModel(id ModelID) {
+	modelRegistryMu.Lock()
+	defer modelRegistryMu.Unlock()
+	delete(SupportedModels, id)
+	delete(ModelSamplingDefaults, id)
+}
+
+// modelSamplingDefaults reads id's sampling defaults from the shared
+// registry under modelRegistryMu.
+func modelSamplingDefaults(id ModelID) SamplingParams {
+	modelRegistryMu.RLock()
+	defer modelRegistryMu.RUnlock()
+	return ModelSamplingDefaults[id]
+}
+
+func samplingParamsFromSlot(slot localSlot) SamplingParams {
+	p := slot.Params
+	return SamplingParams{
+		Temperature:      &p.Temperature,
+		TopK:             &p.TopK,
+		TopP:             &p.TopP,
+		MinP:             &p.MinP,
+		TypicalP:         &p.TypicalP,
+		RepeatLastN:      &p.RepeatLastN,
+		RepeatPenalty:    &p.RepeatPenalty,
+		PresencePenalty:  &p.PresencePenalty,
+		FrequencyPenalty: &p.FrequencyPenalty,
+		Mirostat:         &p.Mirostat,
+		MirostatTau:      &p.MirostatTau,
+		MirostatEta:      &p.MirostatEta,
+		DryMultiplier:    &p.DryMultiplier,
+		DryBase:          &p.DryBase,
+		DryAllowedLength: &p.DryAllowedLength,
+		DryPenaltyLastN:  &p.DryPenaltyLastN,
+		XtcProbability:   &p.XtcProbability,
+		XtcThreshold:     &p.XtcThreshold,
+		Grammar:          p.Grammar,
+	}
+}
+
+// ResolveSamplingParams returns the sampling parameters to use for agent on
+// modelID: the defaults observed from the model's local server slot,
+// overridden field-by-field by anything set under the viper config section
+// agents.<name>.sampling. Unrecognized keys under that section are kept in
+// Extra for passthrough.
+func ResolveSamplingParams(agentName string, modelID ModelID) SamplingParams {
+	params := modelSamplingDefaults(modelID)
+
+	overrides := viper.GetStringMap(fmt.Sprintf("agents.%s.sampling", agentName))
+	if len(overrides) == 0 {
+		return params
+	}
+
+	applyFloat := func(key string, dst **float64) {
+		if v, ok := overrides[key]; ok {
+			if f, ok := toFloat64(v); ok {
+				*dst = &f
+			}
+		}
+	}
+	applyInt := func(key string, dst **int) {
+		if v, ok := overrides[key]; ok {
+			if f, ok := toFloat64(v); ok {
+				n := int(f)
+				*dst = &n
+			}
+		}
+	}
+
+	applyFloat("temperature", &params.Temperature)
+	applyInt("top_k", &params.TopK)
+	applyFloat("top_p", &params.TopP)
+	applyFloat("min_p", &params.MinP)
+	applyFloat("typical_p", &params.TypicalP)
+	applyInt("repeat_last_n", &params.RepeatLastN)
+	applyFloat("repeat_penalty", &params.RepeatPenalty)
+	applyFloat("presence_penalty", &params.PresencePenalty)
+	applyFloat("frequency_penalty", &params.FrequencyPenalty)
+	applyInt("mirostat", &params.Mirostat)
+	applyFloat("mirostat_tau", &params.MirostatTau)
+	applyFloat("mirostat_eta", &params.MirostatEta)
+	applyFloat("dry_multiplier", &params.DryMultiplier)
+	applyFloat("dry_base", &params.DryBase)
+	applyInt("dry_allowed_length", &params.DryAllowedLength)
+	applyInt("dry_penalty_last_n", &params.DryPenaltyLastN)
+	applyFloat("xtc_probability", &params.XtcProbability)
+	applyFloat("xtc_threshold", &params.XtcThreshold)
+
+	if v, ok := overrides["grammar"].(string); ok {
+		params.Grammar = v
+	}
+	if v, ok := overrides["json_schema"]; ok {
+		if raw, err := json.Marshal(v); err == nil {
+			params.JSONSchema = raw
+		}
+	}
+
+	known := map[string]bool{
+		"temperature": true, "top_k": true, "top_p": true, "min_p": true,
+		"typical_p": true, "repeat_last_n": true, "repeat_penalty": true,
+		"presence_penalty": true, "frequency_penalty": true, "mirostat": true,
+		"mirostat_tau": true, "mirostat_eta": true, "dry_multiplier": true,
+		"dry_base": true, "dry_allowed_length": true, "dry_penalty_last_n": true,
+		"xtc_probability": true, "xtc_threshold": true, "grammar": true,
+		"json_schema": true,
+	}
+	for key, value := range overrides {
+		if !known[key] {
+			if params.Extra == nil {
+				params.Extra = map[string]any{}
+			}
+			params.Extra[key] = value
+		}
+	}
+
+	return params
+}
+
+func toFloat64(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// ToRequestParams renders p for inclusion in an outbound completion request.
+// llama.cpp accepts every sampler key directly at the top level of the
+// request body. For OpenAI-compatible passthrough (LM Studio, or any other
+// OpenAI-shaped API), only the keys that API already understands belong at
+// the top level; everything else — including Extra and any llama.cpp-only
+// knob the user set — is nested under extra_body so the server can ignore or
+// honor it without failing schema validation.
+func (p SamplingParams) ToRequestParams(nativeLlamaCpp bool) map[string]any {
+	native := map[string]any{}
+	add := func(key string, value any) {
+		native[key] = value
+	}
+
+	if p.Temperature != nil {
+		add("temperature", *p.Temperature)
+	}
+	if p.TopP != nil {
+		add("top_p", *p.TopP)
+	}
+	if p.PresencePenalty != nil {
+		add("presence_penalty", *p.PresencePenalty)
+	}
+	if p.FrequencyPenalty != nil {
+		add("frequency_penalty", *p.FrequencyPenalty)
+	}
+
+	extraBody := map[string]any{}
+	addExtra := func(key string, value any) {
+		extraBody[key] = value
+	}
+	if p.TopK != nil {
+		addExtra("top_k", *p.TopK)
+	}
+	if p.MinP != nil {
+		addExtra("min_p", *p.MinP)
+	}
+	if p.TypicalP != nil {
+		addExtra("typical_p", *p.TypicalP)
+	}
+	if p.RepeatLastN != nil {
+		addExtra("repeat_last_n", *p.RepeatLastN)
+	}
+	if p.RepeatPenalty != nil {
+		addExtra("repeat_penalty", *p.RepeatPenalty)
+	}
+	if p.Mirostat != nil {
+		addExtra("mirostat", *p.Mirostat)
+	}
+	if p.MirostatTau != nil {
+		addExtra("mirostat_tau", *p.MirostatTau)
+	}
+	if p.MirostatEta != nil {
+		addExtra("mirostat_eta", *p.MirostatEta)
+	}
+	if p.DryMultiplier != nil {
+		addExtra("dry_multiplier", *p.DryMultiplier)
+	}
+	if p.DryBase != nil {
+		addExtra("dry_base", *p.DryBase)
+	}
+	if p.DryAllowedLength != nil {
+		addExtra("dry_allowed_length", *p.DryAllowedLength)
+	}
+	if p.DryPenaltyLastN != nil {
+		addExtra("dry_penalty_last_n", *p.DryPenaltyLastN)
+	}
+	if p.XtcProbability != nil {
+		addExtra("xtc_probability", *p.XtcProbability)
+	}
+	if p.XtcThreshold != nil {
+		addExtra("xtc_threshold", *p.XtcThreshold)
+	}
+	if p.Grammar != "" {
+		addExtra("grammar", p.Grammar)
+	}
+	if len(p.JSONSchema) > 0 {
+		addExtra("json_schema", json.RawMessage(p.JSONSchema))
+	}
+	for k, v := range p.Extra {
+		addExtra(k, v)
+	}
+
+	if nativeLlamaCpp {
+		for k, v := range extraBody {
+			native[k] = v
+		}
+		return native
+	}
+
+	if len(extraBody) > 0 {
+		native["extra_body"] = extraBody
+	}
+	return native
+}
+
+// isLlamaCppModel reports whether modelID was registered for the llama.cpp
+// backend, i.e. has the "local.llamacpp." prefix convertLocalModel assigns.
+func isLlamaCppModel(modelID ModelID) bool {
+	return strings.HasPrefix(string(modelID), "local."+string(backendLlamaCpp)+".")
+}
+
+// CompletionRequestParams resolves the sampling parameters for agentName on
+// modelID — provider defaults observed from the server merged with any
+// agents.<name>.sampling override — and renders them for inclusion in the
+// outbound completion request body. It returns the map only; it does not
+// build, send or modify a completion request itself.
+func CompletionRequestParams(agentName string, modelID ModelID) map[string]any {
+	params := ResolveSamplingParams(agentName, modelID)
+	return params.ToRequestParams(isLlamaCppModel(modelID))
+}
+
 var modelInfoRegex = regexp.MustCompile(`(?i)^([a-z0-9]+)(?:[-_]?([rv]?\d[\.\d]*))?(?:[-_]?([a-z]+))?.*`)
 
-func friendlyModelName(modelID string) string {
+func capitalize(s string) string {
+	if s == "" {
+		return ""
+	}
+	runes := []rune(s)
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
+
+// friendlyOllamaName formats an Ollama model name (e.g. "qwen2.5-coder",
+// "llama3.1"). modelInfoRegex assumes the GGUF-filename shape LM Studio and
+// llama.cpp report (family, then a separate version token, then a separate
+// label token) and mangles Ollama's dotted/hyphenated names by dropping
+// everything after the first version digit, so Ollama names are formatted
+// directly instead: each "-"/"_"-separated segment is capitalized as a
+// whole, leaving embedded version numbers like "2.5" intact.
+func friendlyOllamaName(mainID, tag string) string {
+	segments := strings.FieldsFunc(mainID, func(r rune) bool {
+		return r == '-' || r == '_'
+	})
+	for i, s := range segments {
+		segments[i] = capitalize(s)
+	}
+
+	name := strings.Join(segments, " ")
+	if name == "" {
+		name = mainID
+	}
+	if tag != "" {
+		name += " " + tag
+	}
+	return name
+}
+
+// friendlyModelName turns a backend-reported model ID into a human-readable
+// name. Ollama IDs carry their quantization/variant tag after a colon (e.g.
+// "qwen2.5-coder:7b") rather than the "@" LM Studio and llama.cpp use, so the
+// tag separator is chosen per backend.
+func friendlyModelName(backend localBackendKind, modelID string) string {
 	mainID := modelID
 	tag := ""
 
@@ -344,9 +930,18 @@ func friendlyModelName(modelID string) string {
 		mainID = mainID[slash+1:]
 	}
 
-	if at := strings.Index(modelID, "@"); at != -1 {
-		mainID = modelID[:at]
-		tag = modelID[at+1:]
+	switch backend {
+	case backendOllama:
+		if colon := strings.Index(mainID, ":"); colon != -1 {
+			tag = mainID[colon+1:]
+			mainID = mainID[:colon]
+		}
+		return friendlyOllamaName(mainID, tag)
+	default:
+		if at := strings.Index(mainID, "@"); at != -1 {
+			tag = mainID[at+1:]
+			mainID = mainID[:at]
+		}
 	}
 
 	match := modelInfoRegex.FindStringSubmatch(mainID)
@@ -354,15 +949,6 @@ func friendlyModelName(modelID string) string {
 		return modelID
 	}
 
-	capitalize := func(s string) string {
-		if s == "" {
-			return ""
-		}
-		runes := []rune(s)
-		runes[0] = unicode.ToUpper(runes[0])
-		return string(runes)
-	}
-
 	family := capitalize(match[1])
 	version := ""
 	label := ""
@@ -391,3 +977,169 @@ func friendlyModelName(modelID string) string {
 
 	return strings.Join(parts, " ")
 }
+
+// defaultWatchInterval is how often a Watcher re-polls its LocalProvider
+// when no interval is given.
+const defaultWatchInterval = 30 * time.Second
+
+// ModelEventKind identifies what changed about a local model between two
+// Watcher polls.
+type ModelEventKind string
+
+const (
+	ModelAdded           ModelEventKind = "model_added"
+	ModelRemoved         ModelEventKind = "model_removed"
+	ModelStateChanged    ModelEventKind = "model_state_changed"
+	ContextLengthChanged ModelEventKind = "context_length_changed"
+)
+
+// ModelEvent describes a single change a Watcher observed. Model is the
+// current state (zero value for ModelRemoved); PreviousModel is populated
+// for every kind except ModelAdded.
+type ModelEvent struct {
+	Kind          ModelEventKind
+	ModelID       ModelID
+	Model         Model
+	PreviousModel Model
+}
+
+// Watcher periodically re-polls a LocalProvider and emits events when the
+// set of discovered models, or their state and context length, changes.
+// Consumers such as a TUI or session manager can subscribe to Events to stay
+// in sync with a local server whose loaded model can change at any time.
+type Watcher struct {
+	provider *LocalProvider
+	interval time.Duration
+	events   chan ModelEvent
+
+	mu      sync.Mutex
+	current map[ModelID]discoveredModel
+}
+
+// NewWatcher builds a Watcher over p. interval defaults to
+// defaultWatchInterval when zero or negative.
+func (p *LocalProvider) NewWatcher(interval time.Duration) *Watcher {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+
+	return &Watcher{
+		provider: p,
+		interval: interval,
+		events:   make(chan ModelEvent, 16),
+		current:  map[ModelID]discoveredModel{},
+	}
+}
+
+// Events returns the channel ModelEvents are published on. It is closed
+// once Run returns.
+func (w *Watcher) Events() <-chan ModelEvent {
+	return w.events
+}
+
+// Run polls the watcher's provider on its configured interval until ctx is
+// cancelled. It blocks, so callers should run it in its own goroutine.
+func (w *Watcher) Run(ctx context.Context) {
+	defer close(w.events)
+
+	w.poll(ctx)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.poll(ctx)
+		}
+	}
+}
+
+func (w *Watcher) poll(ctx context.Context) {
+	discovered, err := w.provider.discoverRaw(ctx)
+	if err != nil {
+		logging.Debug("local model rediscovery failed", "error", err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seen := make(map[ModelID]bool, len(discovered))
+	for _, d := range discovered {
+		seen[d.model.ID] = true
+
+		prev, known := w.current[d.model.ID]
+		switch {
+		case !known:
+			registerSupportedModel(d.model, d.raw.sampling)
+			w.emit(ModelEvent{Kind: ModelAdded, ModelID: d.model.ID, Model: d.model})
+		case prev.model.ContextWindow != d.model.ContextWindow:
+			registerSupportedModel(d.model, d.raw.sampling)
+			w.emit(ModelEvent{Kind: ContextLengthChanged, ModelID: d.model.ID, Model: d.model, PreviousModel: prev.model})
+		case prev.raw.State != d.raw.State:
+			registerSupportedModel(d.model, d.raw.sampling)
+			w.emit(ModelEvent{Kind: ModelStateChanged, ModelID: d.model.ID, Model: d.model, PreviousModel: prev.model})
+		}
+
+		w.current[d.model.ID] = d
+	}
+
+	for id, prev := range w.current {
+		if seen[id] {
+			continue
+		}
+
+		delete(w.current, id)
+		unregisterSupportedModel(id)
+		w.emit(ModelEvent{Kind: ModelRemoved, ModelID: id, PreviousModel: prev.model})
+		reassignFallbackModel(id, discovered)
+	}
+}
+
+func (w *Watcher) emit(e ModelEvent) {
+	select {
+	case w.events <- e:
+	default:
+		logging.Debug("dropping local model event, channel full", "kind", e.Kind, "model", e.ModelID)
+	}
+}
+
+// watchedAgents lists the agent config keys whose model the watcher will
+// steer away from a model that just disappeared. It mirrors the defaults
+// LocalProvider.Register seeds on first discovery.
+var watchedAgents = []string{"coder", "summarizer", "task", "title"}
+
+// reassignFallbackModel points any agent currently configured to removedID
+// at another currently discovered local model: the first one whose state is
+// "loaded", or the first discovered model when none reports that state. A
+// model disappearing mid-session thus degrades to a different model instead
+// of failing every subsequent request. When no local model remains, the
+// agents are left unchanged.
+func reassignFallbackModel(removedID ModelID, discovered []discoveredModel) {
+	if len(discovered) == 0 {
+		return
+	}
+
+	fallback := discovered[0].model.ID
+	for _, d := range discovered {
+		if d.raw.State == "loaded" {
+			fallback = d.model.ID
+			break
+		}
+	}
+
+	for _, agent := range watchedAgents {
+		key := fmt.Sprintf("agents.%s.model", agent)
+		if ModelID(viper.GetString(key)) == removedID {
+			logging.Debug("local model disappeared, falling back to next loaded model",
+				"agent", agent,
+				"from", removedID,
+				"to", fallback,
+			)
+			viper.Set(key, string(fallback))
+		}
+	}
+}
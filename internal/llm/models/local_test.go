@@ -0,0 +1,48 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestCompletionRequestParamsAppliesAgentOverride(t *testing.T) {
+	modelID := ModelID("local.llamacpp.test-model")
+	t.Cleanup(func() {
+		unregisterSupportedModel(modelID)
+		viper.Set("agents.coder.sampling", nil)
+	})
+
+	registerSupportedModel(Model{ID: modelID}, &SamplingParams{})
+	viper.Set("agents.coder.sampling", map[string]any{"temperature": 0.42})
+
+	params := CompletionRequestParams("coder", modelID)
+
+	temperature, ok := params["temperature"].(float64)
+	if !ok {
+		t.Fatalf("expected temperature override to reach request params, got %#v", params)
+	}
+	if temperature != 0.42 {
+		t.Fatalf("expected temperature 0.42, got %v", temperature)
+	}
+}
+
+func TestCompletionRequestParamsNestsUnknownKnobsForPassthroughBackends(t *testing.T) {
+	modelID := ModelID("local.lmstudio.test-model")
+	t.Cleanup(func() {
+		unregisterSupportedModel(modelID)
+		viper.Set("agents.coder.sampling", nil)
+	})
+
+	viper.Set("agents.coder.sampling", map[string]any{"top_k": 40})
+
+	params := CompletionRequestParams("coder", modelID)
+
+	extraBody, ok := params["extra_body"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected extra_body in request params, got %#v", params)
+	}
+	if extraBody["top_k"] != 40 {
+		t.Fatalf("expected top_k override to reach extra_body, got %#v", extraBody)
+	}
+}